@@ -0,0 +1,109 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2015 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Command gotest2subunit reads the JSON test events produced by
+// `go test -json` on stdin and writes an equivalent Subunit v2 stream to
+// stdout, so existing subunit-consuming CI infrastructure can ingest Go
+// test results without a custom testing.T harness.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/elopio/subunit"
+)
+
+// testEvent mirrors the JSON objects `go test -json` writes to stdout, one
+// per line. Only the fields the bridge needs are decoded.
+type testEvent struct {
+	Time    time.Time
+	Action  string
+	Package string
+	Test    string
+	Output  string
+}
+
+// actionStatus maps `go test -json` actions to Subunit statuses. "output"
+// has no entry because bridge forwards it as a file attachment; other
+// actions with no entry (such as "pause", "cont" or "bench") are ignored.
+var actionStatus = map[string]string{
+	"run":  "inprogress",
+	"pass": "success",
+	"fail": "fail",
+	"skip": "skip",
+}
+
+func main() {
+	if err := bridge(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "gotest2subunit:", err)
+		os.Exit(1)
+	}
+}
+
+// bridge decodes `go test -json` events from in and writes the equivalent
+// Subunit v2 stream to out.
+func bridge(in io.Reader, out io.Writer) error {
+	stream := &subunit.StreamResultToBytes{Output: out}
+	decoder := json.NewDecoder(in)
+	for {
+		var ev testEvent
+		if err := decoder.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if ev.Test == "" {
+			// A package-level event: build failures, "ok"/"FAIL" summary
+			// lines and the like have no test of their own to report.
+			continue
+		}
+		testID := ev.Package + "." + ev.Test
+
+		if ev.Action == "output" {
+			// The attachment is correlated to the currently running test by
+			// packet order, the same way the subunit stdout stream works;
+			// it carries no test ID of its own.
+			if err := stream.File(subunit.Event{
+				FileName:    "stdout",
+				MIME:        "text/plain",
+				FileContent: []byte(ev.Output),
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		status, ok := actionStatus[ev.Action]
+		if !ok {
+			continue
+		}
+		if err := stream.Status(subunit.Event{
+			TestID:    testID,
+			Status:    status,
+			Timestamp: ev.Time,
+		}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2015 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/elopio/subunit"
+)
+
+type collectingResult struct {
+	events []subunit.Event
+}
+
+func (c *collectingResult) Status(e subunit.Event) error {
+	c.events = append(c.events, e)
+	return nil
+}
+
+func TestBridgeMapsActionsAndOutput(t *testing.T) {
+	const input = `
+{"Time":"2020-01-02T15:04:05Z","Action":"run","Package":"pkg","Test":"TestFoo"}
+{"Time":"2020-01-02T15:04:05Z","Action":"output","Package":"pkg","Test":"TestFoo","Output":"ok so far\n"}
+{"Time":"2020-01-02T15:04:06Z","Action":"pass","Package":"pkg","Test":"TestFoo"}
+{"Time":"2020-01-02T15:04:06Z","Action":"fail","Package":"pkg","Test":"TestBar"}
+{"Time":"2020-01-02T15:04:06Z","Action":"skip","Package":"pkg","Test":"TestBaz"}
+{"Time":"2020-01-02T15:04:06Z","Action":"pause","Package":"pkg","Test":"TestFoo"}
+{"Time":"2020-01-02T15:04:07Z","Action":"pass","Package":"pkg"}
+`
+
+	var out bytes.Buffer
+	if err := bridge(strings.NewReader(input), &out); err != nil {
+		t.Fatalf("bridge returned an error: %s", err)
+	}
+
+	reader := subunit.StreamResultReader{Input: &out}
+	result := &collectingResult{}
+	if err := reader.ReadAndDeliver(result); err != nil {
+		t.Fatalf("failed to decode the bridged stream: %s", err)
+	}
+
+	want := []struct {
+		testID string
+		status string
+	}{
+		{"pkg.TestFoo", "inprogress"},
+		{"pkg.TestFoo", "success"},
+		{"pkg.TestBar", "fail"},
+		{"pkg.TestBaz", "skip"},
+	}
+	var got []subunit.Event
+	for _, e := range result.events {
+		if e.FileContent != nil {
+			continue
+		}
+		got = append(got, e)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d status events, want %d: %+v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		if got[i].TestID != w.testID || got[i].Status != w.status {
+			t.Errorf("event %d: got {%s %s}, want {%s %s}",
+				i, got[i].TestID, got[i].Status, w.testID, w.status)
+		}
+	}
+
+	var attachment *subunit.Event
+	for i := range result.events {
+		if result.events[i].FileContent != nil {
+			attachment = &result.events[i]
+		}
+	}
+	if attachment == nil {
+		t.Fatal("no file attachment packet was produced for the output event")
+	}
+	if attachment.FileName != "stdout" || string(attachment.FileContent) != "ok so far\n" {
+		t.Errorf("unexpected attachment: %+v", attachment)
+	}
+}
@@ -0,0 +1,304 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2015 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package subunit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+)
+
+// errBadPacket is returned internally when a packet fails to decode or its
+// CRC32 does not match. It is never returned to callers of ReadAndDeliver;
+// instead decoding resynchronizes on the next signature byte and continues.
+var errBadPacket = fmt.Errorf("subunit: malformed packet")
+
+// statusNames is the inverse of status, used to turn the three status bits
+// of a decoded packet back into the string Event.Status expects.
+var statusNames = make(map[byte]string, len(status))
+
+func init() {
+	for name, flag := range status {
+		statusNames[flag] = name
+	}
+}
+
+// StreamResult is implemented by types that want to receive the events
+// decoded from a Subunit v2 stream. StreamResultToBytes satisfies it on the
+// write side; StreamResultReader is its counterpart on the read side.
+type StreamResult interface {
+	Status(e Event) error
+}
+
+// StreamResultReader decodes a Subunit v2 byte stream read from Input.
+type StreamResultReader struct {
+	Input io.Reader
+}
+
+// ReadAndDeliver decodes packets from Input until it is exhausted, calling
+// result.Status for each successfully decoded Event. A packet that fails
+// CRC32 verification or is otherwise malformed is dropped, and decoding
+// resumes by scanning forward for the next signature byte.
+func (r *StreamResultReader) ReadAndDeliver(result StreamResult) error {
+	br := bufio.NewReader(r.Input)
+	for {
+		e, err := readPacket(br)
+		switch err {
+		case nil:
+			if err := result.Status(*e); err != nil {
+				return err
+			}
+		case io.EOF:
+			return nil
+		case errBadPacket:
+			continue
+		default:
+			return err
+		}
+	}
+}
+
+// readPacket resynchronizes on the next signature byte, decodes one packet
+// and verifies its CRC32 before decoding its payload.
+func readPacket(br *bufio.Reader) (*Event, error) {
+	if err := seekSignature(br); err != nil {
+		return nil, err
+	}
+
+	flags := make([]byte, 2)
+	if _, err := io.ReadFull(br, flags); err != nil {
+		return nil, truncatedPacket(err)
+	}
+
+	length, lengthSize, err := readNumberSized(br)
+	if err != nil {
+		return nil, truncatedPacket(err)
+	}
+	// Reject an out-of-range length before it is used to size an
+	// allocation: a corrupted or adversarial packet must not be able to
+	// make us allocate up to the four-byte encoding's ~1GB ceiling.
+	if length > maxPacketLen {
+		return nil, errBadPacket
+	}
+	// length counts the whole packet: signature + flags + length field +
+	// payload + CRC32.
+	remaining := length - 1 - 2 - lengthSize
+	if remaining < 4 {
+		return nil, errBadPacket
+	}
+	payload := make([]byte, remaining-4)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, truncatedPacket(err)
+	}
+	crcBytes := make([]byte, 4)
+	if _, err := io.ReadFull(br, crcBytes); err != nil {
+		return nil, truncatedPacket(err)
+	}
+
+	var packet bytes.Buffer
+	packet.WriteByte(signature)
+	packet.Write(flags)
+	writeNumber(&packet, length)
+	packet.Write(payload)
+	if crc32.ChecksumIEEE(packet.Bytes()) != binary.BigEndian.Uint32(crcBytes) {
+		return nil, errBadPacket
+	}
+
+	return decodePayload(flags, payload)
+}
+
+// truncatedPacket turns the EOF a short read leaves behind into
+// errBadPacket: once seekSignature has found a signature byte, running out
+// of input before the packet is complete means it is malformed, not that
+// the stream ended cleanly. A clean end is only ever reported by
+// seekSignature itself, before any packet has started.
+func truncatedPacket(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errBadPacket
+	}
+	return err
+}
+
+// seekSignature advances br past any bytes that do not start a packet.
+func seekSignature(br *bufio.Reader) error {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == signature {
+			return nil
+		}
+	}
+}
+
+// decodePayload turns the bytes following PACKET_LENGTH into an Event,
+// following the field order TIMESTAMP? TESTID? TAGS? MIME? FILECONTENT?
+// ROUTING_CODE? dictated by the flags.
+func decodePayload(flags, payload []byte) (*Event, error) {
+	e := &Event{Status: statusNames[flags[1]&0x7]}
+	r := bytes.NewReader(payload)
+
+	if flags[0]&timestampPresent != 0 {
+		var sec uint32
+		if err := binary.Read(r, binary.BigEndian, &sec); err != nil {
+			return nil, errBadPacket
+		}
+		nsec, err := readNumber(r)
+		if err != nil {
+			return nil, errBadPacket
+		}
+		e.Timestamp = time.Unix(int64(sec), int64(nsec))
+	}
+
+	var testID string
+	if flags[0]&testIDPresent != 0 {
+		id, err := readString(r)
+		if err != nil {
+			return nil, errBadPacket
+		}
+		testID = id
+	}
+
+	if flags[1]&tagsPresent != 0 {
+		count, err := readNumber(r)
+		if err != nil {
+			return nil, errBadPacket
+		}
+		for i := 0; i < count; i++ {
+			tag, err := readString(r)
+			if err != nil {
+				return nil, errBadPacket
+			}
+			if strings.HasPrefix(tag, "-") {
+				e.UntagCurrent = append(e.UntagCurrent, tag[1:])
+			} else {
+				e.Tags = append(e.Tags, tag)
+			}
+		}
+	}
+
+	if flags[1]&mimePresent != 0 {
+		mime, err := readString(r)
+		if err != nil {
+			return nil, errBadPacket
+		}
+		e.MIME = mime
+	}
+
+	if flags[1]&fileContentPresent != 0 {
+		content, err := readString(r)
+		if err != nil {
+			return nil, errBadPacket
+		}
+		e.FileContent = []byte(content)
+	}
+
+	if flags[0]&routingCodePresent != 0 {
+		code, err := readString(r)
+		if err != nil {
+			return nil, errBadPacket
+		}
+		e.RoutingCode = code
+	}
+
+	e.EOF = flags[1]&eofPresent != 0
+
+	// FILECONTENT packets reuse the TESTID slot to carry the attachment's
+	// name instead of a test identifier.
+	if flags[1]&fileContentPresent != 0 {
+		e.FileName = testID
+	} else {
+		e.TestID = testID
+	}
+
+	return e, nil
+}
+
+// readNumber decodes a single variable-length number in the format written
+// by writeNumber.
+func readNumber(r io.ByteReader) (int, error) {
+	n, _, err := readNumberSized(r)
+	return n, err
+}
+
+// readNumberSized is readNumber, additionally reporting how many bytes the
+// encoded number occupied.
+func readNumberSized(r io.ByteReader) (value int, size int, err error) {
+	b0, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	size = int((b0&0xc0)>>6) + 1
+	v0 := int(b0 & 0x3f)
+	switch size {
+	case 1:
+		return v0, 1, nil
+	case 2:
+		b1, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		return (v0 << 8) | int(b1), 2, nil
+	case 3:
+		b1, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		b2, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		return (v0 << 16) | (int(b1) << 8) | int(b2), 3, nil
+	default: // 4
+		b1, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		b2, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		b3, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		return (v0 << 24) | (int(b1) << 16) | (int(b2) << 8) | int(b3), 4, nil
+	}
+}
+
+// readString decodes a variable-length number followed by that many bytes,
+// the encoding writeNumber-prefixed strings use throughout the protocol.
+func readString(r *bytes.Reader) (string, error) {
+	n, err := readNumber(r)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
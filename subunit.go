@@ -26,14 +26,31 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"sync"
 	"time"
 )
 
+// crcTable is shared by every write, avoiding crc32.ChecksumIEEE's per-call
+// table lookup.
+var crcTable = crc32.MakeTable(crc32.IEEE)
+
+// bufferPool holds the scratch buffers write uses to assemble a packet,
+// sparing callers that stream many events a per-event allocation.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
 const (
-	signature        byte = 0xb3
-	version          byte = 0x2
-	testIDPresent    byte = 0x8
-	timestampPresent byte = 0x2
+	signature          byte = 0xb3
+	version            byte = 0x2
+	testIDPresent      byte = 0x8
+	timestampPresent   byte = 0x2
+	routingCodePresent byte = 0x4
+
+	tagsPresent        byte = 0x80
+	fileContentPresent byte = 0x40
+	mimePresent        byte = 0x20
+	eofPresent         byte = 0x10
 )
 
 var status = map[string]byte{
@@ -72,79 +89,153 @@ type StreamResultToBytes struct {
 
 // Event is a status or a file attachment event.
 type Event struct {
-	TestID    string
-	Status    string
-	Timestamp time.Time
+	TestID       string
+	Status       string
+	Timestamp    time.Time
+	Tags         []string
+	UntagCurrent []string
+	RoutingCode  string
+
+	// MIME, FileName, FileContent and EOF describe a file attachment
+	// packet. FileName is carried over the wire in the same slot as
+	// TestID.
+	MIME        string
+	FileName    string
+	FileContent []byte
+	EOF         bool
 }
 
+// write assembles a packet synchronously into a pooled buffer and writes it
+// to writer. The packet's length is computed analytically from the sizes
+// of its fields before anything is written, so the buffer is filled
+// front-to-back exactly once, and its CRC32 is accumulated incrementally as
+// each field is appended rather than recomputed over the finished packet.
 func (e *Event) write(writer io.Writer) error {
 	// PACKET := SIGNATURE FLAGES PACKET_LENGTH TIMESTAMP? TESTID? TAGS? MIME? FILECONTENT?
 	//           ROUTING_CODE? CRC32
 
-	flagsChan := make(chan []byte)
-	go e.makeFlags(flagsChan)
-
-	timestampChan := make(chan []byte)
-	go e.makeTimestamp(timestampChan)
-
-	idChan := make(chan []byte)
-	go e.makeTestID(idChan)
-
-	// We construct a temporary buffer because we won't know the lenght until it's finished.
-	// Then we insert the lenght.
-	var bTemp bytes.Buffer
-	bTemp.WriteByte(signature)
-	bTemp.Write(<-flagsChan)
-	bTemp.Write(<-timestampChan)
-	bTemp.Write(<-idChan)
-
-	length, err := makeLen(bTemp.Len())
+	baseLen := sizeWithoutContent(*e)
+	if e.FileContent != nil {
+		baseLen += numberLen(len(e.FileContent)) + len(e.FileContent)
+	}
+	length, err := makeLen(baseLen)
 	if err != nil {
 		return err
 	}
-	// Insert the length.
-	var b bytes.Buffer
-	b.Write(bTemp.Next(3)) // signature (1 byte) and flags (2 bytes)
-	writeNumber(&b, length)
-	b.Write(bTemp.Next(bTemp.Len()))
 
-	// Add the CRC32
-	crc := crc32.ChecksumIEEE(b.Bytes())
-	binary.Write(&b, binary.BigEndian, crc)
+	b := bufferPool.Get().(*bytes.Buffer)
+	defer bufferPool.Put(b)
+	b.Reset()
+
+	var crc uint32
+	appendField := func(write func(*bytes.Buffer)) {
+		start := b.Len()
+		write(b)
+		crc = crc32.Update(crc, crcTable, b.Bytes()[start:])
+	}
+
+	appendField(func(b *bytes.Buffer) { b.WriteByte(signature) })
+	appendField(e.writeFlags)
+	appendField(func(b *bytes.Buffer) { writeNumber(b, length) })
+	appendField(e.writeTimestamp)
+	appendField(e.writeTestID)
+	appendField(e.writeTags)
+	appendField(e.writeMIME)
+	appendField(e.writeFileContent)
+	appendField(e.writeRoutingCode)
+
+	binary.Write(b, binary.BigEndian, crc)
 
 	_, err = writer.Write(b.Bytes())
 	return err
 }
 
-func (e *Event) makeFlags(c chan<- []byte) {
-	flags := make([]byte, 2, 2)
-	flags[0] = version << 4
-	if e.TestID != "" {
-		flags[0] = flags[0] | testIDPresent
+func (e *Event) writeFlags(b *bytes.Buffer) {
+	flags := [2]byte{version << 4, 0}
+	if e.TestID != "" || e.FileName != "" {
+		flags[0] |= testIDPresent
 	}
 	if !e.Timestamp.IsZero() {
-		flags[0] = flags[0] | timestampPresent
+		flags[0] |= timestampPresent
+	}
+	if e.RoutingCode != "" {
+		flags[0] |= routingCodePresent
 	}
-	flags[1] = flags[1] | status[e.Status]
-	c <- flags
+	if len(e.Tags) > 0 || len(e.UntagCurrent) > 0 {
+		flags[1] |= tagsPresent
+	}
+	if e.MIME != "" {
+		flags[1] |= mimePresent
+	}
+	if e.FileContent != nil {
+		flags[1] |= fileContentPresent
+	}
+	if e.EOF {
+		flags[1] |= eofPresent
+	}
+	flags[1] |= status[e.Status]
+	b.Write(flags[:])
 }
 
-func (e *Event) makeTestID(c chan<- []byte) {
-	var testID bytes.Buffer
-	if e.TestID != "" {
-		writeNumber(&testID, len(e.TestID))
-		testID.WriteString(e.TestID)
+// writeTestID encodes the TESTID field. A file attachment event has no test
+// ID of its own, so it carries its FileName in the same wire slot.
+func (e *Event) writeTestID(b *bytes.Buffer) {
+	id := e.TestID
+	if e.FileName != "" {
+		id = e.FileName
+	}
+	if id != "" {
+		writeNumber(b, len(id))
+		b.WriteString(id)
 	}
-	c <- testID.Bytes()
 }
 
-func (e *Event) makeTimestamp(c chan<- []byte) {
-	var timestamp bytes.Buffer
+// writeTags encodes the TAGS field: a count of tags followed by each tag as
+// a length-prefixed string. Tags being removed (UntagCurrent) are encoded
+// alongside the ones being added, prefixed with "-".
+func (e *Event) writeTags(b *bytes.Buffer) {
+	count := len(e.Tags) + len(e.UntagCurrent)
+	if count == 0 {
+		return
+	}
+	writeNumber(b, count)
+	for _, tag := range e.Tags {
+		writeNumber(b, len(tag))
+		b.WriteString(tag)
+	}
+	for _, tag := range e.UntagCurrent {
+		untag := "-" + tag
+		writeNumber(b, len(untag))
+		b.WriteString(untag)
+	}
+}
+
+func (e *Event) writeRoutingCode(b *bytes.Buffer) {
+	if e.RoutingCode != "" {
+		writeNumber(b, len(e.RoutingCode))
+		b.WriteString(e.RoutingCode)
+	}
+}
+
+func (e *Event) writeMIME(b *bytes.Buffer) {
+	if e.MIME != "" {
+		writeNumber(b, len(e.MIME))
+		b.WriteString(e.MIME)
+	}
+}
+
+func (e *Event) writeFileContent(b *bytes.Buffer) {
+	if e.FileContent != nil {
+		writeNumber(b, len(e.FileContent))
+		b.Write(e.FileContent)
+	}
+}
+
+func (e *Event) writeTimestamp(b *bytes.Buffer) {
 	if !e.Timestamp.IsZero() {
-		binary.Write(&timestamp, binary.BigEndian, uint32(e.Timestamp.Unix()))
-		writeNumber(&timestamp, int(e.Timestamp.UnixNano()%1000000000))
+		binary.Write(b, binary.BigEndian, uint32(e.Timestamp.Unix()))
+		writeNumber(b, int(e.Timestamp.UnixNano()%1000000000))
 	}
-	c <- timestamp.Bytes()
 }
 
 func writeNumber(b io.Writer, num int) (err error) {
@@ -180,3 +271,117 @@ func writeNumber(b io.Writer, num int) (err error) {
 func (s *StreamResultToBytes) Status(e Event) error {
 	return e.write(s.Output)
 }
+
+// maxPacketLen is the largest packet, including its CRC32, that the
+// variable-length fields handled by makeLen and writeNumber can describe.
+const maxPacketLen = 4194303
+
+// File delivers a file attachment, such as captured stdout/stderr or a test
+// log. FileContent is split across as many packets as necessary to keep
+// each one within maxPacketLen; only the last chunk (or the only one, for
+// small attachments) carries the EOF flag the caller asked for.
+func (s *StreamResultToBytes) File(e Event) error {
+	remaining := e.FileContent
+	if remaining == nil {
+		// A zero-byte attachment (e.g. an EOF marker with no content of
+		// its own) must still be encoded as a file content packet, not a
+		// plain status event, so the slice has to be non-nil here.
+		remaining = []byte{}
+	}
+	wantEOF := e.EOF
+	first := true
+	for {
+		chunk := e
+		if !first {
+			// Subsequent chunks of the same attachment don't repeat its
+			// name, MIME type or timestamp.
+			chunk.FileName = ""
+			chunk.MIME = ""
+			chunk.Timestamp = time.Time{}
+		}
+
+		budget, err := maxFileContentLen(chunk)
+		if err != nil {
+			return err
+		}
+		n := len(remaining)
+		last := true
+		if n > budget {
+			n = budget
+			last = false
+		}
+		chunk.FileContent = remaining[:n]
+		chunk.EOF = last && wantEOF
+
+		if err := chunk.write(s.Output); err != nil {
+			return err
+		}
+
+		remaining = remaining[n:]
+		first = false
+		if last {
+			return nil
+		}
+	}
+}
+
+// maxFileContentLen returns how many bytes of FileContent can still be
+// added to e before the resulting packet would exceed maxPacketLen.
+func maxFileContentLen(e Event) (int, error) {
+	e.FileContent = nil
+	overhead := sizeWithoutContent(e)
+	// +4 for the CRC32, plus the worst case 3 bytes each for the packet
+	// length field and the file content's own length prefix.
+	budget := maxPacketLen - overhead - 4 - 3 - 3
+	if budget <= 0 {
+		return 0, fmt.Errorf("event fields leave no room for file content")
+	}
+	return budget, nil
+}
+
+// sizeWithoutContent returns the number of bytes the SIGNATURE, FLAGS,
+// TIMESTAMP, TESTID, TAGS, MIME and ROUTING_CODE fields of e occupy,
+// ignoring FileContent.
+func sizeWithoutContent(e Event) int {
+	size := 1 + 2 // signature + flags
+	if !e.Timestamp.IsZero() {
+		size += 4 + numberLen(int(e.Timestamp.UnixNano()%1000000000))
+	}
+	id := e.TestID
+	if e.FileName != "" {
+		id = e.FileName
+	}
+	if id != "" {
+		size += numberLen(len(id)) + len(id)
+	}
+	if count := len(e.Tags) + len(e.UntagCurrent); count > 0 {
+		size += numberLen(count)
+		for _, tag := range e.Tags {
+			size += numberLen(len(tag)) + len(tag)
+		}
+		for _, tag := range e.UntagCurrent {
+			size += numberLen(len(tag)+1) + len(tag) + 1
+		}
+	}
+	if e.MIME != "" {
+		size += numberLen(len(e.MIME)) + len(e.MIME)
+	}
+	if e.RoutingCode != "" {
+		size += numberLen(len(e.RoutingCode)) + len(e.RoutingCode)
+	}
+	return size
+}
+
+// numberLen returns how many bytes writeNumber uses to encode n.
+func numberLen(n int) int {
+	switch {
+	case n < 64:
+		return 1
+	case n < 16384:
+		return 2
+	case n < 4194304:
+		return 3
+	default:
+		return 4
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"encoding/binary"
 	"hash/crc32"
 	"strings"
+	"testing"
 	"time"
 
 	"github.com/elopio/subunit"
@@ -31,6 +32,12 @@ import (
 	check "gopkg.in/check.v1"
 )
 
+// Test hooks gocheck into go test; without it none of the SubunitSuite
+// methods below ever run.
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
 var _ = check.Suite(&SubunitSuite{})
 
 type SubunitSuite struct {
@@ -205,6 +212,192 @@ func (s *SubunitSuite) TestWithTimestampPacketMustSetPresentFlag(c *check.C) {
 		check.Commentf("Timestamp present flag is not set"))
 }
 
+type collectingResult struct {
+	events []subunit.Event
+}
+
+func (c *collectingResult) Status(e subunit.Event) error {
+	c.events = append(c.events, e)
+	return nil
+}
+
+func (s *SubunitSuite) TestRoundTrip(c *check.C) {
+	events := []subunit.Event{
+		{TestID: "test-one", Status: "inprogress", Timestamp: time.Unix(1234567890, 0)},
+		{TestID: "test-one", Status: "success", Timestamp: time.Unix(1234567891, 0)},
+		{TestID: "test-two", Status: "fail"},
+	}
+	for _, e := range events {
+		c.Assert(s.stream.Status(e), check.IsNil)
+	}
+
+	reader := subunit.StreamResultReader{Input: &s.output}
+	result := &collectingResult{}
+	c.Assert(reader.ReadAndDeliver(result), check.IsNil)
+	c.Assert(result.events, check.DeepEquals, events)
+}
+
+func (s *SubunitSuite) TestCorruptedPacketIsSkippedAndStreamResyncs(c *check.C) {
+	var badBuf bytes.Buffer
+	badStream := &subunit.StreamResultToBytes{Output: &badBuf}
+	c.Assert(badStream.Status(subunit.Event{TestID: "bad", Status: "fail"}), check.IsNil)
+	corrupted := append([]byte(nil), badBuf.Bytes()...)
+	corrupted[len(corrupted)-1] ^= 0xff // Flip a bit in the CRC32.
+
+	c.Assert(s.stream.Status(subunit.Event{TestID: "good", Status: "success"}), check.IsNil)
+	good := append([]byte(nil), s.output.Bytes()...)
+
+	s.output.Reset()
+	s.output.Write(corrupted)
+	s.output.Write(good)
+
+	reader := subunit.StreamResultReader{Input: &s.output}
+	result := &collectingResult{}
+	c.Assert(reader.ReadAndDeliver(result), check.IsNil)
+	c.Assert(result.events, check.HasLen, 1,
+		check.Commentf("the packet with the mismatched CRC32 should have been dropped"))
+	c.Check(result.events[0].TestID, check.Equals, "good",
+		check.Commentf("the stream did not resynchronize on the next packet"))
+}
+
+func (s *SubunitSuite) TestOversizedLengthIsRejectedWithoutHugeAllocationAndResyncs(c *check.C) {
+	var malformed bytes.Buffer
+	malformed.WriteByte(0xb3)           // signature
+	malformed.Write([]byte{0x20, 0x00}) // flags (version only)
+	// A 4-byte-encoded length near 2^29: far beyond maxPacketLen, and
+	// with no payload bytes following it in the stream.
+	var hugeLength bytes.Buffer
+	binary.Write(&hugeLength, binary.BigEndian, uint32(1<<29)|0xc0000000)
+	malformed.Write(hugeLength.Bytes())
+
+	c.Assert(s.stream.Status(subunit.Event{TestID: "good", Status: "success"}), check.IsNil)
+	good := append([]byte(nil), s.output.Bytes()...)
+
+	s.output.Reset()
+	s.output.Write(malformed.Bytes())
+	s.output.Write(good)
+
+	reader := subunit.StreamResultReader{Input: &s.output}
+	result := &collectingResult{}
+	c.Assert(reader.ReadAndDeliver(result), check.IsNil)
+	c.Assert(result.events, check.HasLen, 1,
+		check.Commentf("the packet with the out-of-range length should have been dropped"))
+	c.Check(result.events[0].TestID, check.Equals, "good",
+		check.Commentf("the stream did not resynchronize on the next packet"))
+}
+
+func (s *SubunitSuite) TestZeroByteFileAttachmentRoundTrip(c *check.C) {
+	err := s.stream.File(subunit.Event{FileName: "x", EOF: true})
+	c.Assert(err, check.IsNil)
+
+	reader := subunit.StreamResultReader{Input: &s.output}
+	result := &collectingResult{}
+	c.Assert(reader.ReadAndDeliver(result), check.IsNil)
+	c.Assert(result.events, check.HasLen, 1)
+	c.Check(result.events[0].FileName, check.Equals, "x",
+		check.Commentf("a zero-byte attachment was decoded as a plain status event"))
+	c.Check(result.events[0].FileContent, check.NotNil)
+	c.Check(result.events[0].EOF, check.Equals, true)
+}
+
+func (s *SubunitSuite) TestFileAttachmentFlags(c *check.C) {
+	err := s.stream.File(subunit.Event{
+		FileName:    "stdout",
+		MIME:        "text/plain",
+		FileContent: []byte("hello"),
+		EOF:         true,
+	})
+	c.Assert(err, check.IsNil)
+	s.output.Next(1) // skip the signature.
+	flags := s.output.Next(2)
+	c.Check(flags[1]&0x40, check.Equals, uint8(0x40),
+		check.Commentf("FileContent present flag is not set"))
+	c.Check(flags[1]&0x20, check.Equals, uint8(0x20),
+		check.Commentf("MIME present flag is not set"))
+	c.Check(flags[1]&0x10, check.Equals, uint8(0x10),
+		check.Commentf("EOF flag is not set"))
+}
+
+func (s *SubunitSuite) TestFileAttachmentRoundTrip(c *check.C) {
+	err := s.stream.File(subunit.Event{
+		FileName:    "stdout",
+		MIME:        "text/plain",
+		FileContent: []byte("hello world"),
+		EOF:         true,
+	})
+	c.Assert(err, check.IsNil)
+
+	reader := subunit.StreamResultReader{Input: &s.output}
+	result := &collectingResult{}
+	c.Assert(reader.ReadAndDeliver(result), check.IsNil)
+	c.Assert(result.events, check.HasLen, 1)
+	c.Check(result.events[0].FileName, check.Equals, "stdout")
+	c.Check(result.events[0].MIME, check.Equals, "text/plain")
+	c.Check(result.events[0].FileContent, check.DeepEquals, []byte("hello world"))
+	c.Check(result.events[0].EOF, check.Equals, true)
+}
+
+func (s *SubunitSuite) TestFileAttachmentChunksLargeContent(c *check.C) {
+	content := bytes.Repeat([]byte("x"), 10*1024*1024) // bigger than one packet.
+	err := s.stream.File(subunit.Event{
+		FileName:    "big",
+		MIME:        "text/plain",
+		FileContent: content,
+		EOF:         true,
+	})
+	c.Assert(err, check.IsNil)
+
+	reader := subunit.StreamResultReader{Input: &s.output}
+	result := &collectingResult{}
+	c.Assert(reader.ReadAndDeliver(result), check.IsNil)
+	c.Check(len(result.events) > 1, check.Equals, true,
+		check.Commentf("expected the attachment to span more than one packet, got %d", len(result.events)))
+
+	var rebuilt []byte
+	eofCount := 0
+	for i, e := range result.events {
+		rebuilt = append(rebuilt, e.FileContent...)
+		if e.EOF {
+			eofCount++
+			c.Check(i, check.Equals, len(result.events)-1,
+				check.Commentf("EOF flag was set before the last chunk"))
+		} else if i > 0 {
+			c.Check(e.FileName, check.Equals, "",
+				check.Commentf("continuation chunk repeated FileName"))
+			c.Check(e.MIME, check.Equals, "",
+				check.Commentf("continuation chunk repeated MIME"))
+		}
+	}
+	c.Check(eofCount, check.Equals, 1, check.Commentf("exactly one chunk should carry EOF"))
+	c.Check(rebuilt, check.DeepEquals, content)
+}
+
+func (s *SubunitSuite) TestTagsAndRoutingCodeRoundTrip(c *check.C) {
+	event := subunit.Event{
+		TestID:       "test-one",
+		Status:       "success",
+		Tags:         []string{"slow", "gui"},
+		UntagCurrent: []string{"flaky"},
+		RoutingCode:  "worker-1",
+	}
+	c.Assert(s.stream.Status(event), check.IsNil)
+	// Peek at the flags without consuming them, since the reader below
+	// needs the whole packet, signature included.
+	flags := s.output.Bytes()[1:3]
+	c.Check(flags[0]&0x4, check.Equals, uint8(0x4),
+		check.Commentf("RoutingCode present flag is not set"))
+	c.Check(flags[1]&0x80, check.Equals, uint8(0x80),
+		check.Commentf("Tags present flag is not set"))
+
+	reader := subunit.StreamResultReader{Input: &s.output}
+	result := &collectingResult{}
+	c.Assert(reader.ReadAndDeliver(result), check.IsNil)
+	c.Assert(result.events, check.HasLen, 1)
+	c.Check(result.events[0].Tags, check.DeepEquals, event.Tags)
+	c.Check(result.events[0].UntagCurrent, check.DeepEquals, event.UntagCurrent)
+	c.Check(result.events[0].RoutingCode, check.Equals, event.RoutingCode)
+}
+
 func (s *SubunitSuite) TestPacketTimestamp(c *check.C) {
 	t := time.Now()
 	s.stream.Status(subunit.Event{Timestamp: t})
@@ -219,5 +412,29 @@ func (s *SubunitSuite) TestPacketTimestamp(c *check.C) {
 	nsec := s.readNumber()
 
 	timestamp := time.Unix(int64(sec), int64(nsec))
-	c.Assert(timestamp, check.Equals, t, check.Commentf("Wrong timestamp"))
+	// t carries a monotonic reading that time.Unix can never reproduce;
+	// strip it before comparing, as the wire format only round-trips the
+	// wall clock value.
+	c.Assert(timestamp, check.Equals, t.Round(0), check.Commentf("Wrong timestamp"))
+}
+
+// BenchmarkStatus measures the cost of writing a single event, which
+// streaming writers may call tens of thousands of times per run.
+func BenchmarkStatus(b *testing.B) {
+	var out bytes.Buffer
+	stream := &subunit.StreamResultToBytes{Output: &out}
+	event := subunit.Event{
+		TestID:    "benchmark-test",
+		Status:    "success",
+		Timestamp: time.Now(),
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		out.Reset()
+		if err := stream.Status(event); err != nil {
+			b.Fatal(err)
+		}
+	}
 }